@@ -0,0 +1,113 @@
+package gooplog
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tailerInfoUpdater is the slice of *mgo.Collection that checkpointer
+// needs, broken out so tests can exercise the batching logic with a fake.
+type tailerInfoUpdater interface {
+	Update(selector interface{}, update interface{}) error
+}
+
+// Default batching parameters for checkpointer: Advance flushes at most once
+// per batch of checkpointBatchSize advanced ops; OpLogTailer.checkpointTicker
+// flushes at least every checkpointBufferTimeout regardless of how many ops
+// have been advanced, so the two together give "every N ops or T ms,
+// whichever comes first" even when the tailer goes idle.
+const (
+	checkpointBatchSize     = 100
+	checkpointBufferTimeout = time.Second
+)
+
+// checkpointer owns the resume-token persistence for one OpLogTailer. Every
+// write to opLogTailerInfo.StartReadingFromTime happens under its mu (in
+// Advance, and in OpLogTailer.produce when a rescan resets it to the oplog
+// head), and it batches writes to tailerInfoCollection instead of writing on every op, so
+// that tailers with a high throughput don't hammer Mongo.
+//
+// Advance must only be called once the corresponding op has been fully
+// handled - either because a registered OpLogger callback returned, or
+// because an OpC consumer called Op.Ack() - never at send time, or a crash
+// between persisting and processing would lose that op.
+type checkpointer struct {
+	mu         sync.Mutex
+	collection tailerInfoUpdater
+	info       *opLogTailerInfo
+	pending    int
+}
+
+func newCheckpointer(collection tailerInfoUpdater, info *opLogTailerInfo) *checkpointer {
+	return &checkpointer{
+		collection: collection,
+		info:       info,
+	}
+}
+
+// Advance records ts as fully processed and flushes to Mongo once
+// checkpointBatchSize ops have been advanced. The other half of "every N ops
+// or T ms, whichever comes first" - checkpointBufferTimeout - is driven by a
+// timer in OpLogTailer.produce rather than here, so it still fires on an
+// idle tailer that isn't calling Advance at all.
+func (c *checkpointer) Advance(ts bson.MongoTimestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ts <= c.info.StartReadingFromTime {
+		return
+	}
+	c.info.StartReadingFromTime = ts
+	c.pending++
+
+	if c.pending >= checkpointBatchSize {
+		c.flushLocked()
+	}
+}
+
+// MarkDirty records that info was mutated outside of Advance (e.g. rescan
+// completion flipping RescanCompleted) so the next flush persists it even
+// though no op timestamp actually changed.
+func (c *checkpointer) MarkDirty() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending++
+}
+
+// Checkpoint forces any pending advance to be written to Mongo immediately,
+// regardless of the batching thresholds. Callers should call this on
+// shutdown so a clean stop doesn't lose an already-advanced batch.
+func (c *checkpointer) Checkpoint() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *checkpointer) flushLocked() {
+	if c.pending == 0 {
+		return
+	}
+	c.collection.Update(bson.M{"label": c.info.Label}, c.info)
+	c.pending = 0
+}
+
+// selector returns the selector used to find this tailer's persisted
+// opLogTailerInfo document.
+func (c *checkpointer) selector() bson.M {
+	return bson.M{"label": c.info.Label}
+}
+
+// oplogSelector returns the selector used to query oplog.rs: everything
+// after the current resume timestamp that also passes the Filter's
+// server-side predicate.
+func (c *checkpointer) oplogSelector() bson.M {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return bson.M{"$and": []bson.M{
+		{"ts": bson.M{"$gt": c.info.StartReadingFromTime}},
+		c.info.Filter.selector(),
+	}}
+}
@@ -0,0 +1,68 @@
+package gooplog
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type fakeTailerInfoUpdater struct {
+	updates int
+}
+
+func (f *fakeTailerInfoUpdater) Update(selector interface{}, update interface{}) error {
+	f.updates++
+	return nil
+}
+
+func TestCheckpointerAdvanceIsMonotonic(t *testing.T) {
+	info := &opLogTailerInfo{Label: "test", StartReadingFromTime: 5}
+	c := newCheckpointer(&fakeTailerInfoUpdater{}, info)
+
+	c.Advance(3)
+	if info.StartReadingFromTime != 5 {
+		t.Errorf("Advance should not move StartReadingFromTime backwards, got %d", info.StartReadingFromTime)
+	}
+
+	c.Advance(10)
+	if info.StartReadingFromTime != 10 {
+		t.Errorf("expected StartReadingFromTime to advance to 10, got %d", info.StartReadingFromTime)
+	}
+}
+
+func TestCheckpointerMarkDirtyForcesFlush(t *testing.T) {
+	info := &opLogTailerInfo{Label: "test", RescanCompleted: true}
+	fake := &fakeTailerInfoUpdater{}
+	c := newCheckpointer(fake, info)
+
+	c.MarkDirty()
+	c.Checkpoint()
+
+	if fake.updates != 1 {
+		t.Errorf("expected MarkDirty to force a write with no Advance, got %d updates", fake.updates)
+	}
+}
+
+func TestCheckpointerBatchesWrites(t *testing.T) {
+	info := &opLogTailerInfo{Label: "test", StartReadingFromTime: 0}
+	fake := &fakeTailerInfoUpdater{}
+	c := newCheckpointer(fake, info)
+
+	var ts bson.MongoTimestamp
+	for i := 0; i < checkpointBatchSize-1; i++ {
+		ts++
+		c.Advance(ts)
+	}
+
+	if fake.updates != 0 {
+		t.Errorf("expected no writes before the batch threshold, got %d", fake.updates)
+	}
+
+	c.Checkpoint()
+	if fake.updates != 1 {
+		t.Errorf("expected Checkpoint to flush pending advances in a single write, got %d", fake.updates)
+	}
+	if c.pending != 0 {
+		t.Errorf("expected Checkpoint to clear pending, got pending=%d", c.pending)
+	}
+}
@@ -0,0 +1,51 @@
+package gooplog
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupeWindow tracks IDs recently emitted by a rescan so the tail phase
+// can skip re-delivering an insert for a document the rescan already
+// backfilled. Entries are pruned once older than ttl so the map doesn't
+// grow unbounded once the tail has caught up with the rescan.
+type dedupeWindow struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	seenAt map[interface{}]time.Time
+}
+
+func newDedupeWindow(ttl time.Duration) *dedupeWindow {
+	return &dedupeWindow{ttl: ttl, seenAt: make(map[interface{}]time.Time)}
+}
+
+// add records that id was just emitted.
+func (w *dedupeWindow) add(id interface{}) {
+	if id == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seenAt[id] = time.Now()
+}
+
+// seen reports whether id was added within ttl of now, pruning any entries
+// (including id's own, if expired) that have aged out as a side effect.
+func (w *dedupeWindow) seen(id interface{}) bool {
+	if id == nil {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for seenID, at := range w.seenAt {
+		if now.Sub(at) > w.ttl {
+			delete(w.seenAt, seenID)
+		}
+	}
+
+	_, ok := w.seenAt[id]
+	return ok
+}
@@ -0,0 +1,29 @@
+package gooplog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupeWindowSeen(t *testing.T) {
+	w := newDedupeWindow(time.Minute)
+
+	if w.seen("a") {
+		t.Errorf("expected unseen id to report false")
+	}
+
+	w.add("a")
+	if !w.seen("a") {
+		t.Errorf("expected recently added id to report true")
+	}
+}
+
+func TestDedupeWindowExpires(t *testing.T) {
+	w := newDedupeWindow(time.Millisecond)
+	w.add("a")
+	time.Sleep(5 * time.Millisecond)
+
+	if w.seen("a") {
+		t.Errorf("expected id to expire after ttl")
+	}
+}
@@ -0,0 +1,63 @@
+package gooplog
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFilterMatchesCommandWhitelist(t *testing.T) {
+	filter := NewFilter().IncludeCommands("drop", "renameCollection").Build()
+
+	drop := &Op{Namespace: "shop.$cmd", Operation: "c", Data: bson.M{"drop": "products"}}
+	if !filter.Matches(drop) {
+		t.Errorf("expected whitelisted command %+v to match", drop)
+	}
+
+	create := &Op{Namespace: "shop.$cmd", Operation: "c", Data: bson.M{"create": "products"}}
+	if filter.Matches(create) {
+		t.Errorf("expected non-whitelisted command %+v to be rejected", create)
+	}
+}
+
+func TestFilterMatchesCommandWithEmptyWhitelist(t *testing.T) {
+	filter := NewFilter().Build()
+
+	create := &Op{Namespace: "shop.$cmd", Operation: "c", Data: bson.M{"create": "products"}}
+	if !filter.Matches(create) {
+		t.Errorf("expected command to match when no whitelist is set, got %+v", create)
+	}
+}
+
+func TestFilterMatchesNamespaceIncludeDB(t *testing.T) {
+	filter := NewFilter().IncludeDB("shop").Build()
+
+	if !filter.matchesNamespace("shop.products") {
+		t.Errorf("expected namespace in included db to match")
+	}
+	if filter.matchesNamespace("other.products") {
+		t.Errorf("expected namespace outside included db to be rejected")
+	}
+}
+
+func TestFilterMatchesNamespaceNoIncludes(t *testing.T) {
+	filter := NewFilter().Build()
+
+	if !filter.matchesNamespace("shop.products") {
+		t.Errorf("expected namespace to match when no includes are set")
+	}
+}
+
+func TestFilterMatchesExcludeCollection(t *testing.T) {
+	filter := NewFilter().IncludeDB("shop").ExcludeCollection("shop.audit").IncludeOps("i", "u").Build()
+
+	audit := &Op{Namespace: "shop.audit", Operation: "i", Data: bson.M{}}
+	if filter.Matches(audit) {
+		t.Errorf("expected excluded collection %+v to be rejected", audit)
+	}
+
+	products := &Op{Namespace: "shop.products", Operation: "i", Data: bson.M{}}
+	if !filter.Matches(products) {
+		t.Errorf("expected non-excluded collection %+v to match", products)
+	}
+}
@@ -5,174 +5,408 @@
 // will start tailing the log and upon detecting one of the events above
 // will dispatch in a separate Go routine to the relevant method provided
 // by the developer.
+//
+// As of this revision the package also exposes a gtm-style streaming
+// API: Start(ctx) returns an *OpContext carrying a channel of *Op values
+// so callers that want more than insert/update/delete can read the
+// stream directly instead of implementing OpLogger.
 package gooplog
 
 import (
+	"context"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"sync"
 	"time"
 )
 
+// errCBufferSize bounds how many lifecycle notices (reconnect attempts,
+// the final terminal error) OpContext.ErrC can hold before producer sends
+// start being dropped. It's sized so a handful of transient reconnects
+// during a flapping replica set can't by themselves fill the channel and
+// crowd out the terminal error a consumer actually needs to see; a
+// consumer that wants every notice should still drain ErrC promptly, and
+// OpLogTailer.Wait() always returns the terminal error regardless of
+// whether it made it onto ErrC.
+const errCBufferSize = 8
+
+// OpLoggerEvent is the payload delivered to an OpLogger's callbacks.
+type OpLoggerEvent struct {
+	Id   interface{}
+	Data bson.M
+}
+
 // The interface that must be implemented and registered with OpLogTailer
 // class so that the events can be dispatched to it.
 type OpLogger interface {
 	// Method called when the OpLogTailer receives a deletion operation.
-	OnDelete(deleted bson.M)
+	OnDelete(event *OpLoggerEvent)
 
 	// Method called when the OpLogTailer receives an update operation.
-	OnUpdate(updated bson.M)
+	OnUpdate(event *OpLoggerEvent)
 
 	// Method called when the OpLogTailer receives an insert operation.
-	OnInsert(inserted bson.M)
+	OnInsert(event *OpLoggerEvent)
 }
 
+// OpLogTailer owns every piece of state needed to tail one label's worth of
+// the oplog: its own Mongo session, its own opLogTailerInfo document and its
+// own checkpointer. Nothing here is package-level, so multiple OpLogTailers
+// with different labels can run in the same process without interfering
+// with each other.
 type OpLogTailer struct {
-	collectionToTail *string
-	session          *mgo.Session
-	opLogger         OpLogger
+	url                  string
+	session              *mgo.Session
+	tailerInfoCollection *mgo.Collection
+	tailerInfo           *opLogTailerInfo
+	checkpoint           *checkpointer
+	opLogger             OpLogger
+	rawOpLogger          RawOpLogger
+	rescanRequested      bool
+	forceRescan          bool
+
+	// Lifecycle/supervision state populated by Start; see supervisor.go.
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	dying  <-chan struct{}
+	done   chan struct{}
+	runErr error
+	iter   *mgo.Iter
 }
 
 // Internal Mongo collection maintained by the OpLog tailer to keep track of information, like
 // the timestamp from which it should start reading on restart.
 type opLogTailerInfo struct {
-	FilterRegex          string              "filterRegex"
+	Filter               *Filter             `bson:"filter"`
 	StartReadingFromTime bson.MongoTimestamp `bson:"startReadingFromTime"`
 	Label                string              `bson:"label"`
+	RescanCompleted      bool                `bson:"rescanCompleted"`
 }
 
-type ObjectId struct {
-	Id string `bson:"_id"`
-}
-
-type opLogEntry struct {
-	Ts bson.MongoTimestamp "ts"
-	V  string              "v"
-	Op string              "op"
-	Ns string              "ns"
-	O  bson.M              "o"
-	O2 ObjectId            `bson:"o2,inline"`
-}
-
-var tailerInfoCollection *mgo.Collection
-var session *mgo.Session
-var tailerInfo *opLogTailerInfo
-
-// Create a new OpLogTailer.
-func NewOpLogTailer(url *string, filterRegex *string, label *string, opLogger OpLogger) *OpLogTailer {
-	var err error
-
-	// Open the Mongo DB session to be shared for all connections.
+// Create a new OpLogTailer. filter selects which namespaces and operations
+// are tailed; build one with NewFilter(). A non-nil error means the tailer
+// couldn't reach Mongo or read its opLogTailerInfo document, and is the
+// caller's to handle - a lost connection at startup is recoverable and
+// shouldn't take down the process.
+func NewOpLogTailer(url *string, filter *Filter, label *string, opLogger OpLogger) (*OpLogTailer, error) {
+	// Open the Mongo DB session for this tailer.
 	seconds, _ := time.ParseDuration("0s")
-	session, err = mgo.DialWithTimeout(*url, seconds)
+	session, err := mgo.DialWithTimeout(*url, seconds)
 	if err != nil {
-		log.Fatalf("Can't open connection to %s: %s", url, err)
+		return nil, fmt.Errorf("can't open connection to %s: %s", *url, err)
 	}
 
 	// Create/open the gooplog Mongo database and create/open the opLogTailerInfo collection.
-	tailerInfoCollection = session.DB("gooplog").C("opLogTailerInfo")
+	tailerInfoCollection := session.DB("gooplog").C("opLogTailerInfo")
+
+	if filter == nil {
+		filter = NewFilter().Build()
+	}
 
-	tailerInfo = &opLogTailerInfo{
-		FilterRegex:          *filterRegex,
+	tailerInfo := &opLogTailerInfo{
+		Filter:               filter,
 		StartReadingFromTime: bson.MongoTimestamp(time.Now().Unix() << 32),
 		Label:                *label}
 
-	// Read the opLogTailerInfo for the collection to be tailed.
-	query := tailerInfoCollection.Find(buildOpLogTailerInfoSelector())
-	var count int
-	count, err = query.Count()
+	// Read the opLogTailerInfo for this label, if one already exists.
+	selector := bson.M{"label": tailerInfo.Label}
+	query := tailerInfoCollection.Find(selector)
+	count, err := query.Count()
 	if err != nil {
-		log.Fatalf("Error getting count for opLogTailerInfo: %+v", err)
+		session.Close()
+		return nil, fmt.Errorf("error getting count for opLogTailerInfo: %s", err)
 	}
 
 	if count > 1 {
-		log.Fatalf("The gooplog collection opLogTailerInfo has more than one document for tailed collection [%s] and label [%s].\n  There should only be one document per tailed collection and label.  Pleaes correct and restart.", tailerInfo.FilterRegex, tailerInfo.Label)
+		session.Close()
+		return nil, fmt.Errorf("the gooplog collection opLogTailerInfo has more than one document for label [%s]; there should only be one document per label, please correct and restart", tailerInfo.Label)
 	}
 
 	if count == 0 {
 
-		// There isn't a document yet for collection and label, so create on.
+		// There isn't a document yet for this label, so create one.
 		log.Printf("Creating %+v", tailerInfo)
 		tailerInfoCollection.Insert(tailerInfo)
 	} else {
 
 		// We've eliminated the count > 1 and count == 0.
-		// This must mean there is exactly 1, so read it in.
-
+		// This must mean there is exactly 1, so read it in. The persisted
+		// filter wins so a resumed tailer keeps the predicate it was
+		// originally started with.
 		query.One(&tailerInfo)
 		log.Printf("Read %+v", tailerInfo)
 	}
 
 	return &OpLogTailer{
-		session:  nil,
-		opLogger: opLogger}
+		url:                  *url,
+		session:              session,
+		tailerInfoCollection: tailerInfoCollection,
+		tailerInfo:           tailerInfo,
+		checkpoint:           newCheckpointer(tailerInfoCollection, tailerInfo),
+		opLogger:             opLogger,
+	}, nil
 }
 
-func buildOpLogTailerInfoSelector() bson.M {
-	var andClause [2]bson.M
+// NewRawOpLogTailer is NewOpLogTailer for consumers that want BSON-faithful
+// OpLogRawEntry values via RawOpLogger instead of the lossy bson.M carried
+// by OpLogger.
+func NewRawOpLogTailer(url *string, filter *Filter, label *string, rawOpLogger RawOpLogger) (*OpLogTailer, error) {
+	tailer, err := NewOpLogTailer(url, filter, label, nil)
+	if err != nil {
+		return nil, err
+	}
+	tailer.rawOpLogger = rawOpLogger
+	return tailer, nil
+}
 
-	andClause[0] = bson.M{"filterRegex": tailerInfo.FilterRegex}
-	andClause[1] = bson.M{"label": tailerInfo.Label}
+// Checkpoint forces this tailer's pending resume timestamp to be written to
+// Mongo immediately, bypassing the usual batching. Call it on shutdown so a
+// clean stop doesn't discard an already-advanced batch.
+func (olt *OpLogTailer) Checkpoint() {
+	olt.checkpoint.Checkpoint()
+}
 
-	opLogTailerInfoSelector := bson.M{"$and": andClause}
-	log.Printf("opLogTailerInfoSelector  = %+v", opLogTailerInfoSelector)
-	return opLogTailerInfoSelector
+// Start begins tailing the oplog and returns an OpContext whose OpC
+// channel receives a *Op for every matching entry. A single producer
+// goroutine owns the mgo iterator; cancelling ctx (or calling the
+// returned Stop()) closes the iterator and drains the goroutine before
+// returning.
+//
+// If an OpLogger or RawOpLogger was registered via NewOpLogTailer/
+// NewRawOpLogTailer its callbacks are still invoked for each entry, so
+// existing callback-based consumers keep working unchanged. For them OpC
+// is best-effort - sends to it are dropped rather than blocking - since
+// the callback already handled the op synchronously. The exception is the
+// rescan backfill (see EnableRescan): its synthetic ops are dispatched to an
+// OpLogger only, so with just a RawOpLogger registered they are delivered
+// through OpC alone and those sends block. A caller with no
+// OpLogger/RawOpLogger registered is a pure channel consumer and MUST
+// drain OpC; the producer blocks sending to it and a caller that doesn't
+// read OpC will stall the tailer.
+func (olt *OpLogTailer) Start(ctx context.Context) (*OpContext, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	olt.cancel = cancel
+	olt.dying = ctx.Done()
+	olt.done = make(chan struct{})
+
+	opC := make(chan *Op)
+	errC := make(chan error, errCBufferSize)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer close(olt.done)
+		olt.produce(ctx, opC, errC, &wg)
+	}()
+
+	return &OpContext{
+		OpC:    opC,
+		ErrC:   errC,
+		cancel: cancel,
+		wg:     &wg,
+	}, nil
 }
 
-func buildOpLogSelector() bson.M {
-	var andClause [2]bson.M
+// produce is the single goroutine that owns the oplog iterator. It
+// optionally backfills matching collections first, then decodes tail
+// entries into *Op values, dispatches them to the registered OpLogger/
+// RawOpLogger (if any) and pushes them onto opC. When no callback consumer
+// is registered, opC is the only way an op is delivered, so the send
+// blocks (applying backpressure) until either it's read or ctx is done;
+// when a callback consumer is registered the op was already delivered
+// synchronously above, so the send is best-effort and never blocks.
+func (olt *OpLogTailer) produce(ctx context.Context, opC chan *Op, errC chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(opC)
+	defer close(errC)
+
+	go olt.checkpointTicker(ctx)
+	go olt.closeIterOnDone(ctx)
+
+	dedupe := newDedupeWindow(rescanDedupeWindow)
+
+	if olt.rescanRequested && (olt.forceRescan || !olt.tailerInfo.RescanCompleted) {
+		headTs, err := olt.rescan(ctx, opC, dedupe)
+		if err != nil {
+			log.Printf("Error during rescan: %s", err)
+			select {
+			case errC <- err:
+			default:
+			}
+			olt.fail(err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
 
-	andClause[0] = bson.M{"ts": bson.M{"$gt": tailerInfo.StartReadingFromTime}}
-	andClause[1] = bson.M{"ns": bson.M{"$regex": bson.RegEx{tailerInfo.FilterRegex, ""}}}
+		olt.checkpoint.mu.Lock()
+		olt.tailerInfo.StartReadingFromTime = headTs
+		olt.tailerInfo.RescanCompleted = true
+		olt.checkpoint.mu.Unlock()
+		// Rescan delivers synthetic ops with Timestamp == 0, so Ack/Advance
+		// never marks the checkpoint dirty; mark it explicitly so this
+		// write isn't skipped as a no-op.
+		olt.checkpoint.MarkDirty()
+		olt.checkpoint.Checkpoint()
+	}
 
-	opLogSelector := bson.M{"$and": andClause}
-	log.Printf("opLogSelector = %+v", opLogSelector)
-	return opLogSelector
-}
+	var iter *mgo.Iter
+	defer func() {
+		if iter != nil {
+			iter.Close()
+		}
+	}()
 
-func (olt *OpLogTailer) Start() error {
-	collection := session.DB("local").C("oplog.rs")
-	log.Printf("coll = %+v", collection)
+	collection := olt.session.DB("local").C("oplog.rs")
+	iter = collection.Find(olt.checkpoint.oplogSelector()).LogReplay().Sort("$natural").Tail(-1)
+	olt.setIter(iter)
 
-	iter := collection.Find(buildOpLogSelector()).LogReplay().Sort("$natural").Tail(-1)
+	backoff := minReconnectBackoff
 
-	var result opLogEntry
+	var entry OpLogRawEntry
 	for {
-		for iter.Next(&result) {
-			log.Printf("result = %+v", result)
-			go func() {
-				tailerInfo.StartReadingFromTime = result.Ts
-				tailerInfoCollection.Update(bson.M{"filterRegex": tailerInfo.FilterRegex, "label": tailerInfo.Label}, tailerInfo)
-			}()
-
-			go func(result opLogEntry) {
-				switch result.Op {
-				case "u":
-					olt.opLogger.OnUpdate(result.O)
-					return
-				case "i":
-					olt.opLogger.OnInsert(result.O)
-					return
-				case "d":
-					olt.opLogger.OnDelete(result.O)
-					return
-				}
-			}(result)
+		select {
+		case <-ctx.Done():
+			return
+		default:
 		}
 
-		if iter.Err() != nil {
-			log.Printf("Got error: %+v", iter.Err())
-			return iter.Close()
+		if iter.Next(&entry) {
+			backoff = minReconnectBackoff
+
+			op, decodeErr := newOp(&entry)
+			if decodeErr != nil {
+				log.Printf("Error decoding oplog entry %+v for OpLogger: %s", entry, decodeErr)
+			}
+			op.DecodeError = decodeErr
+			op.checkpoint = olt.checkpoint
+
+			if op.IsInsert() && dedupe.seen(op.Id) {
+				// rescan already delivered this document; don't replay it.
+				olt.checkpoint.Advance(op.Timestamp)
+				continue
+			}
+
+			if !olt.tailerInfo.Filter.Matches(op) {
+				// Filtered-out entries were never handed to any consumer,
+				// so it's safe to checkpoint past them immediately.
+				olt.checkpoint.Advance(op.Timestamp)
+				continue
+			}
+
+			if olt.opLogger != nil && decodeErr == nil {
+				olt.dispatch(op)
+				// The callback above already ran synchronously, so the
+				// entry is fully handled; checkpoint it now rather than
+				// waiting for an Ack that will never come.
+				olt.checkpoint.Advance(op.Timestamp)
+			}
+
+			if olt.rawOpLogger != nil {
+				olt.dispatchRaw(&entry)
+				olt.checkpoint.Advance(op.Timestamp)
+			}
+
+			if olt.opLogger != nil || olt.rawOpLogger != nil {
+				// Already delivered synchronously above; don't let an
+				// undrained OpC stall the producer for a callback-only
+				// consumer.
+				select {
+				case opC <- op:
+				default:
+				}
+			} else {
+				select {
+				case opC <- op:
+				case <-ctx.Done():
+					return
+				}
+			}
+			continue
 		}
 
 		if iter.Timeout() {
 			continue
 		}
 
-		// If we are here, it means something other than a timeout occurred, so let's
-		// try and restart the tailing cursor.
-		query := collection.Find(buildOpLogSelector())
-		iter = query.Sort("$natural").Tail(5 * time.Second)
+		if err := iter.Err(); err != nil {
+			log.Printf("Got error: %+v", err)
+			select {
+			case errC <- err:
+			default:
+			}
+		}
+
+		// Something other than a timeout occurred - an mgo error or a dead
+		// cursor, most likely because the replica set elected a new primary.
+		// Re-dial to pick up the new primary and back off before
+		// retrying, rather than hammering a cluster that's mid-failover.
+		log.Printf("Tailing cursor lost, reconnecting in %s", backoff)
+		select {
+		case errC <- fmt.Errorf("oplog cursor lost, reconnecting in %s", backoff):
+		default:
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := olt.redial(ctx); err != nil {
+			log.Printf("Error redialing Mongo session: %s", err)
+		}
+		collection = olt.session.DB("local").C("oplog.rs")
+
+		iter.Close()
+		iter = collection.Find(olt.checkpoint.oplogSelector()).Sort("$natural").Tail(5 * time.Second)
+		olt.setIter(iter)
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// setIter records iter as the oplog iterator currently in use, so
+// closeIterOnDone can close it out from under a blocked Next() call once
+// ctx is cancelled.
+func (olt *OpLogTailer) setIter(iter *mgo.Iter) {
+	olt.mu.Lock()
+	olt.iter = iter
+	olt.mu.Unlock()
+}
+
+// dispatch invokes the registered OpLogger's callback matching op's
+// operation type.
+func (olt *OpLogTailer) dispatch(op *Op) {
+	event := &OpLoggerEvent{Id: op.Id, Data: op.Data}
+	switch op.Operation {
+	case "u":
+		olt.opLogger.OnUpdate(event)
+	case "i":
+		olt.opLogger.OnInsert(event)
+	case "d":
+		olt.opLogger.OnDelete(event)
+	}
+}
+
+// dispatchRaw invokes the registered RawOpLogger's callback matching
+// entry's operation type.
+func (olt *OpLogTailer) dispatchRaw(entry *OpLogRawEntry) {
+	switch entry.Operation {
+	case "u":
+		olt.rawOpLogger.OnUpdate(entry)
+	case "i":
+		olt.rawOpLogger.OnInsert(entry)
+	case "d":
+		olt.rawOpLogger.OnDelete(entry)
 	}
-	return iter.Close()
 }
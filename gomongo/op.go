@@ -0,0 +1,135 @@
+package gooplog
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+)
+
+// Op is a decoded oplog entry delivered to consumers of OpContext.OpC.
+type Op struct {
+	Timestamp         bson.MongoTimestamp
+	Namespace         string
+	Operation         string // one of "i", "u", "d", "n", "c"
+	Id                interface{}
+	Data              bson.M
+	UpdateDescription bson.M
+
+	// DecodeError is set when newOp couldn't unmarshal this entry's "o"/"o2"
+	// payload into bson.M. If "o" failed, Data, Id and UpdateDescription are
+	// all nil; if only an update's "o2" failed, Data is set but Id and
+	// UpdateDescription are nil.
+	// Timestamp, Namespace and Operation are always populated regardless,
+	// since they come straight from the oplog entry rather than the decode.
+	// OpC consumers that care about Data must check this before using it.
+	DecodeError error
+
+	checkpoint *checkpointer
+}
+
+// Ack tells the tailer this op has been fully processed, allowing its
+// resume timestamp to be persisted. Consumers reading OpC directly must
+// call Ack once they're done with an op; OpLogger/RawOpLogger callback
+// consumers don't need to - the tailer checkpoints for them as soon as
+// their callback returns.
+func (op *Op) Ack() {
+	if op.checkpoint != nil {
+		op.checkpoint.Advance(op.Timestamp)
+	}
+}
+
+// newOp decodes an OpLogRawEntry read from oplog.rs into an Op, unmarshaling
+// its raw "o"/"o2" payloads into bson.M for the benefit of OpLogger
+// consumers. Callers that need BSON-faithful types should use RawOpLogger
+// instead.
+//
+// newOp always returns a non-nil Op with Timestamp/Namespace/Operation
+// populated, even when the bson.M decode fails - those fields are enough
+// for namespace filtering and RawOpLogger dispatch, which works from entry
+// directly. The command whitelist and dedupe read op.Data and op.Id, and see
+// them empty after a failed decode. A non-nil error means op.Data, or for
+// updates op.UpdateDescription/op.Id, could not be decoded and callers
+// relying on them, i.e. OpLogger, must not be dispatched.
+func newOp(entry *OpLogRawEntry) (*Op, error) {
+	op := &Op{
+		Timestamp: entry.Timestamp,
+		Namespace: entry.Namespace,
+		Operation: entry.Operation,
+	}
+
+	var data bson.M
+	if err := entry.UnmarshalObject(&data); err != nil {
+		return op, err
+	}
+	op.Data = data
+
+	if entry.Operation == "u" {
+		var update bson.M
+		if err := entry.UnmarshalUpdate(&update); err != nil {
+			return op, err
+		}
+		op.UpdateDescription = update
+		if id, ok := update["_id"]; ok {
+			op.Id = id
+		}
+	} else if id, ok := data["_id"]; ok {
+		op.Id = id
+	}
+
+	return op, nil
+}
+
+// IsInsert reports whether op is an insert ("i") operation.
+func (op *Op) IsInsert() bool {
+	return op.Operation == "i"
+}
+
+// IsUpdate reports whether op is an update ("u") operation.
+func (op *Op) IsUpdate() bool {
+	return op.Operation == "u"
+}
+
+// IsDelete reports whether op is a delete ("d") operation.
+func (op *Op) IsDelete() bool {
+	return op.Operation == "d"
+}
+
+// IsCommand reports whether op is a database command ("c") operation,
+// e.g. drop, renameCollection or create.
+func (op *Op) IsCommand() bool {
+	return op.Operation == "c"
+}
+
+// IsDrop reports whether op is a "drop" command.
+func (op *Op) IsDrop() bool {
+	if !op.IsCommand() {
+		return false
+	}
+	_, ok := op.Data["drop"]
+	return ok
+}
+
+// OpContext is returned by OpLogTailer.Start and exposes the streaming
+// API: OpC receives decoded operations, ErrC receives both transient
+// lifecycle notices (e.g. a reconnect) and the final terminal error, and
+// Stop cancels the tailer and waits for it to shut down. Use
+// OpLogTailer.Wait() for the authoritative terminal error - ErrC is
+// best-effort and can drop notices if its buffer fills. A caller with no
+// OpLogger/RawOpLogger registered MUST drain OpC, or the producer blocks
+// indefinitely trying to deliver the next op; callers that did register
+// one don't need to, since OpC sends become best-effort for them (except
+// rescan ops when only a RawOpLogger is registered; see OpLogTailer.Start).
+type OpContext struct {
+	OpC  chan *Op
+	ErrC chan error
+
+	cancel func()
+	wg     *sync.WaitGroup
+}
+
+// Stop cancels the tailer's context, causing its producer goroutine to
+// close the mgo iterator, drain and close OpC/ErrC, then return. Stop
+// blocks until that shutdown has completed.
+func (oc *OpContext) Stop() {
+	oc.cancel()
+	oc.wg.Wait()
+}
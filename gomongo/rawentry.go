@@ -0,0 +1,51 @@
+package gooplog
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpLogRawEntry mirrors an oplog.rs document but keeps the object and
+// update-object payloads as *bson.Raw instead of decoding them into
+// bson.M. This preserves BSON ordering and type fidelity (ObjectIDs,
+// dates, decimals, ...) that would otherwise be lost, and lets each
+// consumer unmarshal into its own domain struct.
+type OpLogRawEntry struct {
+	Timestamp    bson.MongoTimestamp `bson:"ts"`
+	OperationId  int64               `bson:"h"`
+	MongoVersion int                 `bson:"v"`
+	Operation    string              `bson:"op"`
+	Namespace    string              `bson:"ns"`
+	Object       *bson.Raw           `bson:"o"`
+	UpdateObject *bson.Raw           `bson:"o2"`
+}
+
+// UnmarshalObject unmarshals the raw "o" field into out.
+func (e *OpLogRawEntry) UnmarshalObject(out interface{}) error {
+	if e.Object == nil {
+		return nil
+	}
+	return e.Object.Unmarshal(out)
+}
+
+// UnmarshalUpdate unmarshals the raw "o2" field into out.
+func (e *OpLogRawEntry) UnmarshalUpdate(out interface{}) error {
+	if e.UpdateObject == nil {
+		return nil
+	}
+	return e.UpdateObject.Unmarshal(out)
+}
+
+// RawOpLogger is a parallel consumer interface for callers that need
+// BSON-faithful payloads instead of the lossy bson.M delivered via
+// OpLogger. Register one with NewRawOpLogTailer, which takes it in place of
+// an OpLogger.
+type RawOpLogger interface {
+	// Method called when the OpLogTailer receives a deletion operation.
+	OnDelete(entry *OpLogRawEntry)
+
+	// Method called when the OpLogTailer receives an update operation.
+	OnUpdate(entry *OpLogRawEntry)
+
+	// Method called when the OpLogTailer receives an insert operation.
+	OnInsert(entry *OpLogRawEntry)
+}
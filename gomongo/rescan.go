@@ -0,0 +1,143 @@
+package gooplog
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rescanDedupeWindow is how long a document ID seen during rescan is
+// remembered, to skip the matching insert the tail phase will otherwise
+// replay for a document written during the scan, since the tail reads from
+// the oplog head captured before the scan began.
+const rescanDedupeWindow = 5 * time.Minute
+
+// EnableRescan arranges for Start to backfill every collection matching
+// the tailer's Filter as synthetic "i" ops before switching to the oplog
+// tail, so a fresh deployment can build its initial state. The backfill
+// only runs once per label - opLogTailerInfo.RescanCompleted is persisted
+// once it finishes - so restarting the tailer doesn't rescan every time.
+func (olt *OpLogTailer) EnableRescan() *OpLogTailer {
+	olt.rescanRequested = true
+	return olt
+}
+
+// ForceRescan is EnableRescan but reruns the backfill even if a previous
+// run already completed for this label.
+func (olt *OpLogTailer) ForceRescan() *OpLogTailer {
+	olt.rescanRequested = true
+	olt.forceRescan = true
+	return olt
+}
+
+// rescan backfills every matching collection, emitting a synthetic "i" Op
+// for each existing document. It captures the oplog head timestamp before
+// the scan begins and returns it so the caller can resume tailing from
+// there once the scan completes - anything written during the scan is
+// replayed by the tail phase rather than missed. Each emitted ID is
+// recorded in seen so the tail phase can skip the duplicate.
+func (olt *OpLogTailer) rescan(ctx context.Context, opC chan *Op, seen *dedupeWindow) (bson.MongoTimestamp, error) {
+	headTs, err := olt.oplogHead()
+	if err != nil {
+		return 0, err
+	}
+
+	dbNames, err := olt.session.DatabaseNames()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, dbName := range dbNames {
+		if dbName == "local" || dbName == "admin" || dbName == "config" {
+			continue
+		}
+
+		collNames, err := olt.session.DB(dbName).CollectionNames()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, collName := range collNames {
+			if err := olt.rescanCollection(ctx, dbName, collName, opC, seen); err != nil {
+				return headTs, err
+			}
+
+			select {
+			case <-ctx.Done():
+				return headTs, nil
+			default:
+			}
+		}
+	}
+
+	return headTs, nil
+}
+
+func (olt *OpLogTailer) rescanCollection(ctx context.Context, dbName string, collName string, opC chan *Op, seen *dedupeWindow) error {
+	ns := dbName + "." + collName
+
+	probe := &Op{Namespace: ns, Operation: "i"}
+	if !olt.tailerInfo.Filter.allowsOp("i") || !olt.tailerInfo.Filter.matchesNamespace(ns) || !olt.tailerInfo.Filter.Matches(probe) {
+		return nil
+	}
+
+	log.Printf("Rescanning %s", ns)
+
+	iter := olt.session.DB(dbName).C(collName).Find(nil).Iter()
+	defer iter.Close()
+
+	var doc bson.M
+	for iter.Next(&doc) {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		op := &Op{
+			Namespace:  ns,
+			Operation:  "i",
+			Data:       doc,
+			checkpoint: olt.checkpoint,
+		}
+		if id, ok := doc["_id"]; ok {
+			op.Id = id
+			seen.add(id)
+		}
+
+		if olt.opLogger != nil {
+			olt.dispatch(op)
+			// Already delivered synchronously above; don't let an
+			// undrained OpC stall the backfill for a callback-only
+			// consumer.
+			select {
+			case opC <- op:
+			default:
+			}
+		} else {
+			select {
+			case opC <- op:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		doc = nil
+	}
+
+	return iter.Err()
+}
+
+// oplogHead returns the timestamp of the most recent oplog.rs entry.
+func (olt *OpLogTailer) oplogHead() (bson.MongoTimestamp, error) {
+	var last struct {
+		Ts bson.MongoTimestamp `bson:"ts"`
+	}
+	err := olt.session.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&last)
+	if err != nil {
+		return 0, err
+	}
+	return last.Ts, nil
+}
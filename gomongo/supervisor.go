@@ -0,0 +1,139 @@
+package gooplog
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Reconnect backoff bounds applied when the tailing cursor dies for a
+// reason other than a read timeout (e.g. a replica-set primary change).
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// Dying returns a channel that's closed once the tailer has started
+// shutting down, whether that was requested via Stop or triggered
+// internally by an unrecoverable error. It never fires for ordinary
+// reconnects.
+func (olt *OpLogTailer) Dying() <-chan struct{} {
+	return olt.dying
+}
+
+// Stop asks the tailer to shut down and blocks until it has, returning
+// whatever error ended its run (nil on a clean Stop-initiated shutdown).
+// It's equivalent to calling the OpContext.Stop() returned by Start, but
+// lets callers that only kept a reference to the OpLogTailer itself
+// trigger and observe shutdown.
+func (olt *OpLogTailer) Stop() error {
+	if olt.cancel != nil {
+		olt.cancel()
+	}
+	return olt.Wait()
+}
+
+// Wait blocks until the tailer's producer goroutine has exited and
+// returns the error that ended it, if any.
+func (olt *OpLogTailer) Wait() error {
+	<-olt.done
+	olt.mu.Lock()
+	defer olt.mu.Unlock()
+	return olt.runErr
+}
+
+// fail records err as the reason the tailer is shutting down and begins
+// that shutdown, as if Stop had been called.
+func (olt *OpLogTailer) fail(err error) {
+	olt.mu.Lock()
+	if olt.runErr == nil {
+		olt.runErr = err
+	}
+	olt.mu.Unlock()
+
+	if olt.cancel != nil {
+		olt.cancel()
+	}
+}
+
+// checkpointTicker periodically flushes any pending checkpoint advance, so
+// an idle tailer - one that's stopped seeing ops and so has stopped calling
+// Advance - still persists progress within checkpointBufferTimeout instead
+// of waiting indefinitely for the next op or an explicit Checkpoint().
+func (olt *OpLogTailer) checkpointTicker(ctx context.Context) {
+	ticker := time.NewTicker(checkpointBufferTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			olt.checkpoint.Checkpoint()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closeIterOnDone closes the tailer's current oplog iterator as soon as ctx
+// is cancelled. The initial iterator is opened with Tail(-1) - no read
+// timeout - so without this a blocked Next() wouldn't notice cancellation
+// until the next oplog entry (or, on a quiescent replica set, never),
+// breaking the documented contract that cancelling ctx promptly closes the
+// iterator and drains the producer.
+func (olt *OpLogTailer) closeIterOnDone(ctx context.Context) {
+	<-ctx.Done()
+	olt.mu.Lock()
+	if olt.iter != nil {
+		olt.iter.Close()
+	}
+	olt.mu.Unlock()
+}
+
+// redial re-dials this tailer's Mongo session against the same URL it was
+// created with, so a replica-set primary change (or any other lost
+// connection) picks up a fresh primary instead of retrying against a
+// session mgo has given up on. It gives up early if ctx is cancelled so a
+// Stop() during a stuck dial doesn't have to wait out the full dial
+// timeout; the dial keeps running in the background and is adopted if it
+// eventually succeeds, discarded otherwise.
+func (olt *OpLogTailer) redial(ctx context.Context) error {
+	type dialResult struct {
+		session *mgo.Session
+		err     error
+	}
+	resultC := make(chan dialResult, 1)
+
+	go func() {
+		session, err := mgo.DialWithTimeout(olt.url, 5*time.Second)
+		resultC <- dialResult{session, err}
+	}()
+
+	select {
+	case result := <-resultC:
+		if result.err != nil {
+			return result.err
+		}
+		olt.adoptSession(result.session)
+		return nil
+	case <-ctx.Done():
+		go func() {
+			if result := <-resultC; result.err == nil {
+				result.session.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// adoptSession swaps in a freshly dialled session and everything derived
+// from it, closing the one it replaces.
+func (olt *OpLogTailer) adoptSession(newSession *mgo.Session) {
+	old := olt.session
+	olt.session = newSession
+	olt.tailerInfoCollection = newSession.DB("gooplog").C("opLogTailerInfo")
+	olt.checkpoint.mu.Lock()
+	olt.checkpoint.collection = olt.tailerInfoCollection
+	olt.checkpoint.mu.Unlock()
+	old.Close()
+}
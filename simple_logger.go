@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/vsheffer/go-mongo-etl/gomongo"
 	"log"
@@ -23,10 +24,29 @@ func (sl *SimpleLogger) OnUpdate(event *gooplog.OpLoggerEvent) {
 func main() {
 	url := flag.String("mongoUrl", "", "The mongo URL to use for connections.")
 	label := "simpleLogger"
-	filterRegex := "product.*"
 	flag.Parse()
 
-	tailer := gooplog.NewOpLogTailer(url, &filterRegex, &label, &SimpleLogger{})
-
-	tailer.Start()
+	filter := gooplog.NewFilter().NamespaceRegex("product.*").Build()
+	tailer, err := gooplog.NewOpLogTailer(url, filter, &label, &SimpleLogger{})
+	if err != nil {
+		log.Fatalf("Error creating tailer: %s", err)
+	}
+
+	opCtx, err := tailer.Start(context.Background())
+	if err != nil {
+		log.Fatalf("Error starting tailer: %s", err)
+	}
+
+	// SimpleLogger only cares about the OpLogger callbacks above. OpC sends
+	// are best-effort for a registered OpLogger, so the tailer wouldn't
+	// block without this, but draining it is cheap and means nothing is
+	// silently dropped if a future change wants to read OpC here too.
+	go func() {
+		for range opCtx.OpC {
+		}
+	}()
+
+	for err := range opCtx.ErrC {
+		log.Printf("Tailer error: %s", err)
+	}
 }